@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// CacheEntry holds a fully-drained SSE response: the raw "data: ..."
+// frames Copilot received, replayed verbatim on a cache hit.
+type CacheEntry struct {
+	Frames   []string
+	StoredAt time.Time
+}
+
+// Store is the pluggable cache backend. The default is the in-memory
+// lruStore below; a BuntDB- or Redis-backed Store can be swapped in to
+// share the cache across proxy instances without changing ResponseCache.
+type Store interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+}
+
+// ResponseCache adds freshness semantics on top of a Store: entries older
+// than ttl are either treated as a miss (normal mode) or, in stale-while-revalidate
+// mode, still served immediately while the caller kicks off a refresh.
+type ResponseCache struct {
+	store Store
+	ttl   time.Duration
+	swr   bool
+}
+
+func NewResponseCache(store Store, ttl time.Duration, swr bool) *ResponseCache {
+	return &ResponseCache{store: store, ttl: ttl, swr: swr}
+}
+
+// Lookup returns the cached entry to serve, if any, and whether it's
+// stale and should be refreshed in the background after being served.
+func (rc *ResponseCache) Lookup(key string) (entry *CacheEntry, stale bool) {
+	e, ok := rc.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if time.Since(e.StoredAt) <= rc.ttl {
+		return e, false
+	}
+	if rc.swr {
+		return e, true
+	}
+	return nil, false
+}
+
+func (rc *ResponseCache) Store(key string, frames []string) {
+	rc.store.Set(key, &CacheEntry{Frames: frames, StoredAt: time.Now()})
+}
+
+// cacheKeyForBody derives the cache key from the fields that actually
+// determine a codex completion: model, prompt and suffix. Re-requests
+// Copilot fires for cursor jitter carry the same three fields, even when
+// unrelated metadata (nwo, extra, request ids) differs.
+func cacheKeyForBody(body []byte) string {
+	normalized := []byte(`{}`)
+	normalized, _ = sjson.SetBytes(normalized, "model", gjson.GetBytes(body, "model").String())
+	normalized, _ = sjson.SetBytes(normalized, "prompt", gjson.GetBytes(body, "prompt").String())
+	normalized, _ = sjson.SetBytes(normalized, "suffix", gjson.GetBytes(body, "suffix").String())
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:])
+}
+
+type lruItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// lruStore is the default in-memory Store: a plain LRU keyed by cache key,
+// evicting the least-recently-used entry once maxEntries is exceeded.
+type lruStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewLRUStore(maxEntries int) *lruStore {
+	return &lruStore{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (s *lruStore) Get(key string) (*CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.ll.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+func (s *lruStore) Set(key string, entry *CacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		el.Value.(*lruItem).entry = entry
+		s.ll.MoveToFront(el)
+		return
+	}
+
+	s.items[key] = s.ll.PushFront(&lruItem{key: key, entry: entry})
+	if s.maxEntries > 0 && s.ll.Len() > s.maxEntries {
+		oldest := s.ll.Back()
+		if nil != oldest {
+			s.ll.Remove(oldest)
+			delete(s.items, oldest.Value.(*lruItem).key)
+		}
+	}
+}
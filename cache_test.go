@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewLRUStore(2)
+	s.Set("a", &CacheEntry{Frames: []string{"a"}})
+	s.Set("b", &CacheEntry{Frames: []string{"b"}})
+
+	// Touch "a" so "b" becomes the least-recently-used entry.
+	if _, ok := s.Get("a"); !ok {
+		t.Fatal("expected a to be present")
+	}
+	s.Set("c", &CacheEntry{Frames: []string{"c"}})
+
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("b should have been evicted as the least-recently-used entry")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Fatal("a should still be cached")
+	}
+	if _, ok := s.Get("c"); !ok {
+		t.Fatal("c should be cached")
+	}
+}
+
+func TestLRUStoreUpdateMovesToFront(t *testing.T) {
+	s := NewLRUStore(2)
+	s.Set("a", &CacheEntry{Frames: []string{"a1"}})
+	s.Set("b", &CacheEntry{Frames: []string{"b"}})
+	s.Set("a", &CacheEntry{Frames: []string{"a2"}})
+	s.Set("c", &CacheEntry{Frames: []string{"c"}})
+
+	if _, ok := s.Get("b"); ok {
+		t.Fatal("b should have been evicted; a was refreshed more recently")
+	}
+	entry, ok := s.Get("a")
+	if !ok || entry.Frames[0] != "a2" {
+		t.Fatalf("expected updated entry for a, got %+v", entry)
+	}
+}
+
+func TestResponseCacheLookupFreshVsStale(t *testing.T) {
+	store := NewLRUStore(10)
+	rc := NewResponseCache(store, time.Minute, true)
+	rc.Store("k", []string{"frame"})
+
+	entry, stale := rc.Lookup("k")
+	if nil == entry || stale {
+		t.Fatalf("fresh entry should be returned without staleness, got entry=%v stale=%v", entry, stale)
+	}
+
+	store.items["k"].Value.(*lruItem).entry.StoredAt = time.Now().Add(-2 * time.Minute)
+
+	entry, stale = rc.Lookup("k")
+	if nil == entry || !stale {
+		t.Fatalf("expired entry under SWR should still be served and flagged stale, got entry=%v stale=%v", entry, stale)
+	}
+}
+
+func TestResponseCacheLookupExpiredWithoutSWR(t *testing.T) {
+	store := NewLRUStore(10)
+	rc := NewResponseCache(store, time.Minute, false)
+	rc.Store("k", []string{"frame"})
+	store.items["k"].Value.(*lruItem).entry.StoredAt = time.Now().Add(-2 * time.Minute)
+
+	entry, stale := rc.Lookup("k")
+	if nil != entry || stale {
+		t.Fatalf("expired entry without SWR should be a miss, got entry=%v stale=%v", entry, stale)
+	}
+}
+
+func TestCacheKeyForBodyIgnoresUnrelatedFields(t *testing.T) {
+	a := []byte(`{"model":"m","prompt":"p","suffix":"s","nwo":"x","extra":"1"}`)
+	b := []byte(`{"model":"m","prompt":"p","suffix":"s","nwo":"y","extra":"2"}`)
+	if cacheKeyForBody(a) != cacheKeyForBody(b) {
+		t.Fatal("cache key should only depend on model/prompt/suffix")
+	}
+
+	c := []byte(`{"model":"m","prompt":"different","suffix":"s"}`)
+	if cacheKeyForBody(a) == cacheKeyForBody(c) {
+		t.Fatal("cache key should change when prompt differs")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// FimTemplate describes how to wrap a prompt/suffix pair into the
+// fill-in-the-middle format a given code model expects, and which stop
+// tokens mark the end of its completion.
+type FimTemplate struct {
+	Prefix string   `json:"prefix"`
+	Suffix string   `json:"suffix"`
+	Middle string   `json:"middle"`
+	Stop   []string `json:"stop"`
+}
+
+// defaultFimTemplates preserves the two FIM wrappers this proxy has always
+// hardcoded, keyed the same way ConstructRequestBody used to match them:
+// "stable-code" is a substring match against CodeInstructModel, "@" is a
+// prefix match (Cloudflare Workers AI model names, e.g. "@cf/deepseek-coder").
+// Entries in config's fim_templates override a built-in with the same key
+// (otherwise the longest matching key wins) and can add new models (codellama, starcoder2, qwen2.5-coder, ...) without a rebuild.
+var defaultFimTemplates = map[string]FimTemplate{
+	"stable-code": {
+		Prefix: "<fim_prefix>",
+		Suffix: "<fim_suffix>",
+		Middle: "<fim_middle>",
+		Stop:   []string{"<|endoftext|>"},
+	},
+	"@": {
+		Prefix: "<｜fim▁begin｜>",
+		Suffix: "<｜fim▁hole｜>",
+		Middle: "<｜fim▁end｜>",
+		Stop:   []string{"<｜end▁of▁sentence｜>"},
+	},
+}
+
+// lookupFimTemplate finds the FIM template registered for model, checking
+// config-supplied templates first and falling back to the built-in
+// defaults. Keys match either exactly or as a prefix/substring of model,
+// the same way the old hardcoded checks did; the longest matching key wins.
+// "@" is special-cased to a prefix match, same as the original
+// strings.HasPrefix(model, "@") check for Cloudflare Workers AI models.
+// Defaults are considered before config entries and the tie-break is
+// >= rather than >, so a config entry that reuses a built-in key (e.g.
+// redefining "stable-code") overrides it outright instead of losing the
+// tie.
+func lookupFimTemplate(cfg *config, model string) (FimTemplate, bool) {
+	var (
+		best    FimTemplate
+		bestLen = -1
+	)
+	consider := func(key string, tmpl FimTemplate) {
+		matches := strings.Contains(model, key)
+		if key == "@" {
+			matches = strings.HasPrefix(model, key)
+		}
+		if !matches {
+			return
+		}
+		if len(key) >= bestLen {
+			best, bestLen = tmpl, len(key)
+		}
+	}
+	for key, tmpl := range defaultFimTemplates {
+		consider(key, tmpl)
+	}
+	for key, tmpl := range cfg.FimTemplates {
+		consider(key, tmpl)
+	}
+	return best, bestLen >= 0
+}
+
+// constructWithFimTemplate wraps prompt/suffix using tmpl and injects its
+// stop tokens into the upstream request so the model knows where to end
+// its completion.
+func constructWithFimTemplate(body []byte, tmpl FimTemplate) []byte {
+	suffix := gjson.GetBytes(body, "suffix")
+	prompt := gjson.GetBytes(body, "prompt")
+	content := fmt.Sprintf("%s%s%s%s%s", tmpl.Prefix, prompt, tmpl.Suffix, suffix, tmpl.Middle)
+
+	if len(tmpl.Stop) > 0 {
+		body, _ = sjson.SetBytes(body, "stop", tmpl.Stop)
+	}
+
+	messages := []map[string]string{
+		{
+			"role":    "user",
+			"content": content,
+		},
+	}
+	return constructWithChatModel(body, messages)
+}
+
+// stripStopTokens removes any of tmpl's stop tokens that leaked into a
+// streamed delta, since some upstreams echo the stop sequence back in the
+// final chunk instead of truncating before it.
+func stripStopTokens(content string, tmpl FimTemplate) string {
+	for _, stop := range tmpl.Stop {
+		content = strings.ReplaceAll(content, stop, "")
+	}
+	return content
+}
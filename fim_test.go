@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestLookupFimTemplateAtIsPrefixOnly(t *testing.T) {
+	cfg := &config{}
+
+	if _, ok := lookupFimTemplate(cfg, "@cf/deepseek-coder"); !ok {
+		t.Fatal("expected a model prefixed with @ to match the Cloudflare template")
+	}
+	if _, ok := lookupFimTemplate(cfg, "user@example/model"); ok {
+		t.Fatal("@ appearing mid-string should not match; it's a prefix match only")
+	}
+}
+
+func TestLookupFimTemplateSubstringForOtherKeys(t *testing.T) {
+	cfg := &config{}
+	if _, ok := lookupFimTemplate(cfg, "my-stable-code-3b"); !ok {
+		t.Fatal("stable-code should match anywhere in the model name")
+	}
+}
+
+func TestLookupFimTemplateNoMatch(t *testing.T) {
+	cfg := &config{}
+	if _, ok := lookupFimTemplate(cfg, "gpt-4"); ok {
+		t.Fatal("a model with no matching key should report no template")
+	}
+}
+
+func TestLookupFimTemplateConfigOverridesLongestKeyWins(t *testing.T) {
+	cfg := &config{
+		FimTemplates: map[string]FimTemplate{
+			"stable-code-3b": {Stop: []string{"<custom-stop>"}},
+		},
+	}
+	tmpl, ok := lookupFimTemplate(cfg, "stable-code-3b-instruct")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if len(tmpl.Stop) != 1 || tmpl.Stop[0] != "<custom-stop>" {
+		t.Fatalf("got %+v, want the longer config-supplied key to win over the built-in \"stable-code\"", tmpl)
+	}
+}
+
+func TestLookupFimTemplateConfigOverridesSameKeyExactly(t *testing.T) {
+	cfg := &config{
+		FimTemplates: map[string]FimTemplate{
+			"stable-code": {Stop: []string{"<custom-stop>"}},
+		},
+	}
+	tmpl, ok := lookupFimTemplate(cfg, "stable-code-3b")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if len(tmpl.Stop) != 1 || tmpl.Stop[0] != "<custom-stop>" {
+		t.Fatalf("got %+v, want the config-supplied \"stable-code\" template to override the identically-keyed built-in", tmpl)
+	}
+}
+
+func TestStripStopTokens(t *testing.T) {
+	tmpl := FimTemplate{Stop: []string{"<|endoftext|>", "<stop2>"}}
+	got := stripStopTokens("hello<|endoftext|> world<stop2>", tmpl)
+	if got != "hello world" {
+		t.Fatalf("stripStopTokens = %q, want %q", got, "hello world")
+	}
+}
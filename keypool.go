@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ApiKeyConfig describes a single upstream credential. BaseUrl/Organization/
+// Project override the provider-wide defaults when set, so a pool can mix
+// keys that belong to different orgs or even different base URLs.
+type ApiKeyConfig struct {
+	Key          string `json:"key"`
+	Organization string `json:"organization,omitempty"`
+	Project      string `json:"project,omitempty"`
+	BaseUrl      string `json:"base_url,omitempty"`
+}
+
+const (
+	keyPoolBaseCooldown = time.Second
+	keyPoolMaxCooldown  = 5 * time.Minute
+)
+
+var ErrNoHealthyKeys = errors.New("keypool: no healthy keys available")
+
+// apiKey tracks the health of a single credential inside a KeyPool.
+type apiKey struct {
+	cfg ApiKeyConfig
+
+	mu            sync.Mutex
+	failures      int
+	cooldownUntil time.Time
+	lastErr       string
+
+	inFlight int32
+}
+
+func (k *apiKey) healthy(now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return now.After(k.cooldownUntil)
+}
+
+// recordResult feeds an upstream outcome back into the key's health state,
+// cooling it down with exponential backoff on 401/429/5xx and clearing the
+// cooldown on success.
+func (k *apiKey) recordResult(statusCode int, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if nil == err && (statusCode == 0 || statusCode < 400) {
+		k.failures = 0
+		k.cooldownUntil = time.Time{}
+		k.lastErr = ""
+		return
+	}
+
+	if nil != err {
+		k.lastErr = err.Error()
+	} else {
+		k.lastErr = http.StatusText(statusCode)
+	}
+
+	if nil == err && statusCode != http.StatusUnauthorized && statusCode != http.StatusTooManyRequests && statusCode < 500 {
+		// Ordinary 4xx client errors aren't the key's fault; don't cool it down.
+		return
+	}
+
+	k.failures++
+	cooldown := keyPoolBaseCooldown << uint(k.failures-1)
+	if cooldown > keyPoolMaxCooldown || cooldown <= 0 {
+		cooldown = keyPoolMaxCooldown
+	}
+	k.cooldownUntil = time.Now().Add(cooldown)
+}
+
+// KeyStatus is the JSON shape reported by the /admin/keys endpoint.
+type KeyStatus struct {
+	Key           string     `json:"key"`
+	Healthy       bool       `json:"healthy"`
+	InFlight      int32      `json:"in_flight"`
+	Failures      int        `json:"failures"`
+	LastError     string     `json:"last_error,omitempty"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+}
+
+// KeyPool round-robins requests across a set of credentials, tracking
+// per-key health so a key that's hitting 429s or 5xx can be skipped until
+// its cooldown expires instead of failing every request sent its way.
+type KeyPool struct {
+	mu   sync.Mutex
+	next int
+	keys []*apiKey
+}
+
+// NewKeyPool builds a KeyPool from the configured key list, falling back
+// to a single legacy key/org/project/base-url tuple when the list is empty
+// so existing single-key configs keep working unchanged.
+func NewKeyPool(keys []ApiKeyConfig, fallback ApiKeyConfig) *KeyPool {
+	if len(keys) == 0 {
+		keys = []ApiKeyConfig{fallback}
+	}
+	pool := &KeyPool{keys: make([]*apiKey, 0, len(keys))}
+	for _, k := range keys {
+		pool.keys = append(pool.keys, &apiKey{cfg: k})
+	}
+	return pool
+}
+
+// Size returns the number of keys in the pool.
+func (p *KeyPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.keys)
+}
+
+// Acquire returns the next healthy key in round-robin order and marks it
+// in-flight; call Release when the request against it is done.
+func (p *KeyPool) Acquire() (*apiKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.keys); i++ {
+		idx := (p.next + i) % len(p.keys)
+		k := p.keys[idx]
+		if k.healthy(now) {
+			p.next = (idx + 1) % len(p.keys)
+			atomic.AddInt32(&k.inFlight, 1)
+			return k, nil
+		}
+	}
+	return nil, ErrNoHealthyKeys
+}
+
+// Next returns the next healthy key in the pool after exclude, so a
+// failed request can be retried against a different credential.
+func (p *KeyPool) Next(exclude *apiKey) (*apiKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(p.keys); i++ {
+		idx := (p.next + i) % len(p.keys)
+		k := p.keys[idx]
+		if k == exclude || !k.healthy(now) {
+			continue
+		}
+		p.next = (idx + 1) % len(p.keys)
+		atomic.AddInt32(&k.inFlight, 1)
+		return k, nil
+	}
+	return nil, ErrNoHealthyKeys
+}
+
+func (k *apiKey) Release() {
+	atomic.AddInt32(&k.inFlight, -1)
+}
+
+// Snapshot reports the current health of every key for the admin endpoint.
+// Keys are masked to their last 4 characters so the response is safe to
+// expose even to operators who shouldn't see the raw credential.
+func (p *KeyPool) Snapshot() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	statuses := make([]KeyStatus, 0, len(p.keys))
+	now := time.Now()
+	for _, k := range p.keys {
+		k.mu.Lock()
+		status := KeyStatus{
+			Key:       maskKey(k.cfg.Key),
+			Healthy:   now.After(k.cooldownUntil),
+			InFlight:  atomic.LoadInt32(&k.inFlight),
+			Failures:  k.failures,
+			LastError: k.lastErr,
+		}
+		if !k.cooldownUntil.IsZero() {
+			cooldownUntil := k.cooldownUntil
+			status.CooldownUntil = &cooldownUntil
+		}
+		k.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
+}
+
+// isRetryableStatus reports whether a response status code indicates the
+// key (rather than the request itself) is the likely cause of failure.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
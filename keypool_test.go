@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApiKeyRecordResultCooldownAndRecovery(t *testing.T) {
+	k := &apiKey{}
+
+	k.recordResult(http.StatusTooManyRequests, nil)
+	if k.healthy(time.Now()) {
+		t.Fatal("key should be unhealthy immediately after a 429")
+	}
+	if k.failures != 1 {
+		t.Fatalf("failures = %d, want 1", k.failures)
+	}
+
+	firstCooldown := k.cooldownUntil
+	k.recordResult(http.StatusTooManyRequests, nil)
+	if !k.cooldownUntil.After(firstCooldown) {
+		t.Fatal("repeated failures should extend the cooldown (exponential backoff)")
+	}
+
+	k.recordResult(http.StatusOK, nil)
+	if !k.healthy(time.Now()) {
+		t.Fatal("a success should clear the cooldown immediately")
+	}
+	if k.failures != 0 {
+		t.Fatalf("failures = %d, want 0 after success", k.failures)
+	}
+}
+
+func TestApiKeyRecordResultIgnoresOrdinaryClientErrors(t *testing.T) {
+	k := &apiKey{}
+	k.recordResult(http.StatusBadRequest, nil)
+	if !k.healthy(time.Now()) {
+		t.Fatal("a 400 is the caller's fault, not the key's; it should not cool down")
+	}
+	if k.failures != 0 {
+		t.Fatalf("failures = %d, want 0", k.failures)
+	}
+}
+
+func TestApiKeyRecordResultCoolsDownOnTransportError(t *testing.T) {
+	k := &apiKey{}
+	k.recordResult(0, errors.New("dial tcp: connection refused"))
+	if k.healthy(time.Now()) {
+		t.Fatal("a transport error should cool the key down")
+	}
+}
+
+func TestApiKeyRecordResultCooldownCapped(t *testing.T) {
+	k := &apiKey{}
+	for i := 0; i < 10; i++ {
+		k.recordResult(http.StatusInternalServerError, nil)
+	}
+	cooldown := k.cooldownUntil.Sub(time.Now())
+	if cooldown > keyPoolMaxCooldown {
+		t.Fatalf("cooldown = %v, want <= %v", cooldown, keyPoolMaxCooldown)
+	}
+}
+
+func TestKeyPoolNextSkipsExcludedAndUnhealthy(t *testing.T) {
+	pool := NewKeyPool([]ApiKeyConfig{{Key: "a"}, {Key: "b"}, {Key: "c"}}, ApiKeyConfig{})
+
+	bad, err := pool.Acquire()
+	if nil != err {
+		t.Fatalf("Acquire: %v", err)
+	}
+	bad.recordResult(http.StatusTooManyRequests, nil)
+
+	for i := 0; i < pool.Size()-1; i++ {
+		next, err := pool.Next(bad)
+		if nil != err {
+			t.Fatalf("Next: %v", err)
+		}
+		if next == bad {
+			t.Fatal("Next must never return the excluded key")
+		}
+		next.Release()
+	}
+}
+
+func TestKeyPoolAcquireAllUnhealthyReturnsErrNoHealthyKeys(t *testing.T) {
+	pool := NewKeyPool([]ApiKeyConfig{{Key: "a"}}, ApiKeyConfig{})
+	k, err := pool.Acquire()
+	if nil != err {
+		t.Fatalf("Acquire: %v", err)
+	}
+	k.recordResult(http.StatusInternalServerError, nil)
+
+	if _, err := pool.Acquire(); !errors.Is(err, ErrNoHealthyKeys) {
+		t.Fatalf("Acquire error = %v, want ErrNoHealthyKeys", err)
+	}
+}
@@ -24,26 +24,35 @@ import (
 
 const DefaultInstructModel = "gpt-3.5-turbo-instruct"
 
-const StableCodeModelPrefix = "stable-code"
-
 type config struct {
-	Bind                 string            `json:"bind"`
-	ProxyUrl             string            `json:"proxy_url"`
-	Timeout              int               `json:"timeout"`
-	CodexApiBase         string            `json:"codex_api_base"`
-	CodexApiKey          string            `json:"codex_api_key"`
-	CodexApiOrganization string            `json:"codex_api_organization"`
-	CodexApiProject      string            `json:"codex_api_project"`
-	CodeInstructModel    string            `json:"code_instruct_model"`
-	ChatApiBase          string            `json:"chat_api_base"`
-	ChatApiKey           string            `json:"chat_api_key"`
-	ChatApiOrganization  string            `json:"chat_api_organization"`
-	ChatApiProject       string            `json:"chat_api_project"`
-	ChatMaxTokens        int               `json:"chat_max_tokens"`
-	ChatModelDefault     string            `json:"chat_model_default"`
-	ChatModelMap         map[string]string `json:"chat_model_map"`
-	ChatLocale           string            `json:"chat_locale"`
-	AuthToken            string            `json:"auth_token"`
+	Bind                 string                 `json:"bind"`
+	ProxyUrl             string                 `json:"proxy_url"`
+	Timeout              int                    `json:"timeout"`
+	CodexApiBase         string                 `json:"codex_api_base"`
+	CodexApiKey          string                 `json:"codex_api_key"`
+	CodexApiOrganization string                 `json:"codex_api_organization"`
+	CodexApiProject      string                 `json:"codex_api_project"`
+	CodexApiKeys         []ApiKeyConfig         `json:"codex_api_keys"`
+	CodeInstructModel    string                 `json:"code_instruct_model"`
+	ChatApiBase          string                 `json:"chat_api_base"`
+	ChatApiKey           string                 `json:"chat_api_key"`
+	ChatApiOrganization  string                 `json:"chat_api_organization"`
+	ChatApiProject       string                 `json:"chat_api_project"`
+	ChatApiKeys          []ApiKeyConfig         `json:"chat_api_keys"`
+	ChatMaxTokens        int                    `json:"chat_max_tokens"`
+	ChatModelDefault     string                 `json:"chat_model_default"`
+	ChatModelMap         map[string]string      `json:"chat_model_map"`
+	ChatLocale           string                 `json:"chat_locale"`
+	ChatApiProvider      string                 `json:"chat_api_provider"`
+	CodexApiProvider     string                 `json:"codex_api_provider"`
+	ApiVersion           string                 `json:"api_version"`
+	FimTemplates         map[string]FimTemplate `json:"fim_templates"`
+	ContextWindow        int                    `json:"context_window"`
+	Encoding             string                 `json:"encoding"`
+	CacheTtlSeconds      int                    `json:"cache_ttl_seconds"`
+	CacheMaxEntries      int                    `json:"cache_max_entries"`
+	CacheSwr             bool                   `json:"cache_swr"`
+	AuthToken            string                 `json:"auth_token"`
 }
 
 type Message struct {
@@ -63,6 +72,15 @@ type ChatCompletionsStreamResponse struct {
 	Created int64                                 `json:"created"`
 	Model   string                                `json:"model"`
 	Choices []ChatCompletionsStreamResponseChoice `json:"choices"`
+	Usage   *Usage                                `json:"usage,omitempty"`
+}
+
+// Usage carries the upstream's own token accounting, when it sends one on
+// a stream chunk. It takes precedence over estimateTokenCount's BPE/char
+// estimate whenever present.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
 }
 type CustomEvent struct {
 	Event string
@@ -241,6 +259,11 @@ func closeIO(c io.Closer) {
 type ProxyService struct {
 	cfg    *config
 	client *http.Client
+
+	chatKeyPool  *KeyPool
+	codexKeyPool *KeyPool
+
+	codexCache *ResponseCache
 }
 
 func NewProxyService(cfg *config) (*ProxyService, error) {
@@ -249,11 +272,123 @@ func NewProxyService(cfg *config) (*ProxyService, error) {
 		return nil, err
 	}
 
+	chatKeyPool := NewKeyPool(cfg.ChatApiKeys, ApiKeyConfig{
+		Key:          cfg.ChatApiKey,
+		Organization: cfg.ChatApiOrganization,
+		Project:      cfg.ChatApiProject,
+	})
+	codexKeyPool := NewKeyPool(cfg.CodexApiKeys, ApiKeyConfig{
+		Key:          cfg.CodexApiKey,
+		Organization: cfg.CodexApiOrganization,
+		Project:      cfg.CodexApiProject,
+	})
+
+	var codexCache *ResponseCache
+	if cfg.CacheMaxEntries > 0 {
+		ttl := time.Duration(cfg.CacheTtlSeconds) * time.Second
+		if ttl <= 0 {
+			ttl = 30 * time.Second
+		}
+		codexCache = NewResponseCache(NewLRUStore(cfg.CacheMaxEntries), ttl, cfg.CacheSwr)
+	}
+
 	return &ProxyService{
-		cfg:    cfg,
-		client: client,
+		cfg:          cfg,
+		client:       client,
+		chatKeyPool:  chatKeyPool,
+		codexKeyPool: codexKeyPool,
+		codexCache:   codexCache,
 	}, nil
 }
+
+// providerFor builds the Provider for a single attempt against k, falling
+// back to the provider-wide base URL when the key doesn't set its own.
+func (s *ProxyService) providerFor(name string, kind string, base string, k *apiKey) Provider {
+	apiBase := k.cfg.BaseUrl
+	if "" == apiBase {
+		apiBase = base
+	}
+	return NewProvider(name, providerConfig{
+		kind:         kind,
+		apiBase:      apiBase,
+		apiKey:       k.cfg.Key,
+		organization: k.cfg.Organization,
+		project:      k.cfg.Project,
+		apiVersion:   s.cfg.ApiVersion,
+	})
+}
+
+// requestUpstream sends body upstream using the next healthy key from
+// pool, transparently retrying against the following healthy key when
+// upstream returns 401/429/5xx. It returns the response along with the
+// Provider used for the attempt that produced it, since the caller needs
+// it to interpret the response.
+func (s *ProxyService) requestUpstream(ctx context.Context, pool *KeyPool, providerName string, kind string, base string, body []byte) (*http.Response, Provider, error) {
+	attempts := pool.Size()
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var key *apiKey
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		var err error
+		if nil == key {
+			key, err = pool.Acquire()
+		} else {
+			key, err = pool.Next(key)
+		}
+		if nil != err {
+			return nil, nil, err
+		}
+
+		provider := s.providerFor(providerName, kind, base, key)
+		reqURL, headers, payload, err := provider.BuildRequest(body)
+		if nil != err {
+			key.Release()
+			return nil, nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, io.NopCloser(bytes.NewBuffer(payload)))
+		if nil != err {
+			key.Release()
+			return nil, nil, err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := s.client.Do(req)
+		if nil != err {
+			key.recordResult(0, err)
+			key.Release()
+			if errors.Is(err, context.Canceled) {
+				return nil, nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		key.recordResult(resp.StatusCode, nil)
+		key.Release()
+		if isRetryableStatus(resp.StatusCode) && i < attempts-1 {
+			closeIO(resp.Body)
+			lastErr = fmt.Errorf("upstream returned %d", resp.StatusCode)
+			continue
+		}
+
+		return resp, provider, nil
+	}
+
+	return nil, nil, lastErr
+}
+
+func (s *ProxyService) adminKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"chat":  s.chatKeyPool.Snapshot(),
+		"codex": s.codexKeyPool.Snapshot(),
+	})
+}
 func AuthMiddleware(authToken string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Param("token")
@@ -267,6 +402,8 @@ func AuthMiddleware(authToken string) gin.HandlerFunc {
 }
 
 func (s *ProxyService) InitRoutes(e *gin.Engine) {
+	e.Use(MetricsMiddleware())
+
 	authToken := s.cfg.AuthToken // replace with your dynamic value as needed
 	if authToken != "" {
 		// 鉴权
@@ -274,10 +411,14 @@ func (s *ProxyService) InitRoutes(e *gin.Engine) {
 		{
 			v1.POST("/chat/completions", s.completions)
 			v1.POST("/engines/copilot-codex/completions", s.codeCompletions)
+			v1.GET("/admin/keys", s.adminKeys)
 		}
+		e.GET("/:token/metrics", AuthMiddleware(authToken), metricsHandler())
 	} else {
 		e.POST("/v1/chat/completions", s.completions)
 		e.POST("/v1/engines/copilot-codex/completions", s.codeCompletions)
+		e.GET("/v1/admin/keys", s.adminKeys)
+		e.GET("/metrics", metricsHandler())
 	}
 }
 
@@ -290,12 +431,16 @@ func (s *ProxyService) completions(c *gin.Context) {
 		return
 	}
 
+	rm := requestMetrics(c)
 	model := gjson.GetBytes(body, "model").String()
+	rm.Model = model
 	if mapped, ok := s.cfg.ChatModelMap[model]; ok {
 		model = mapped
 	} else {
 		model = s.cfg.ChatModelDefault
 	}
+	rm.MappedModel = model
+	rm.Upstream = s.cfg.ChatApiProvider
 	body, _ = sjson.SetBytes(body, "model", model)
 
 	if !gjson.GetBytes(body, "function_call").Exists() {
@@ -318,34 +463,30 @@ func (s *ProxyService) completions(c *gin.Context) {
 		body, _ = sjson.SetBytes(body, "max_tokens", s.cfg.ChatMaxTokens)
 	}
 
-	proxyUrl := s.cfg.ChatApiBase + "/chat/completions"
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyUrl, io.NopCloser(bytes.NewBuffer(body)))
-	if nil != err {
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+s.cfg.ChatApiKey)
-	if "" != s.cfg.ChatApiOrganization {
-		req.Header.Set("OpenAI-Organization", s.cfg.ChatApiOrganization)
-	}
-	if "" != s.cfg.ChatApiProject {
-		req.Header.Set("OpenAI-Project", s.cfg.ChatApiProject)
+	var promptText strings.Builder
+	for _, m := range gjson.GetBytes(body, "messages").Array() {
+		promptText.WriteString(m.Get("content").String())
 	}
+	rm.PromptTokens = estimateTokenCount(s.cfg, promptText.String())
 
-	resp, err := s.client.Do(req)
+	resp, provider, err := s.requestUpstream(ctx, s.chatKeyPool, s.cfg.ChatApiProvider, "chat", s.cfg.ChatApiBase, body)
 	if nil != err {
 		if errors.Is(err, context.Canceled) {
 			c.AbortWithStatus(http.StatusRequestTimeout)
 			return
 		}
+		if errors.Is(err, ErrNoHealthyKeys) {
+			log.Println("request conversation failed: no healthy chat api keys")
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
 
 		log.Println("request conversation failed:", err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 	defer closeIO(resp.Body)
+	rm.UpstreamStatus = resp.StatusCode
 
 	if resp.StatusCode != http.StatusOK { // log
 		body, _ := io.ReadAll(resp.Body)
@@ -356,12 +497,143 @@ func (s *ProxyService) completions(c *gin.Context) {
 
 	c.Status(resp.StatusCode)
 
-	contentType := resp.Header.Get("Content-Type")
-	if "" != contentType {
-		c.Header("Content-Type", contentType)
+	if isOpenAICompatible(provider) || resp.StatusCode != http.StatusOK {
+		contentType := resp.Header.Get("Content-Type")
+		if "" != contentType {
+			c.Header("Content-Type", contentType)
+		}
+
+		_, _ = io.Copy(c.Writer, resp.Body)
+		return
 	}
 
-	_, _ = io.Copy(c.Writer, resp.Body)
+	// Non-OpenAI upstreams don't speak the OpenAI SSE wire format, so
+	// translate their stream into OpenAI-shaped chunks as it comes in.
+	SetEventStreamHeaders(c)
+	id := GetResponseID(c)
+	// streamCtx is canceled when the client disconnects mid-stream, so
+	// TranslateStream's producer goroutine can stop trying to send
+	// instead of blocking forever on a channel nobody's reading from
+	// anymore.
+	streamCtx, cancelStream := context.WithCancel(c.Request.Context())
+	defer cancelStream()
+	stream := provider.TranslateStream(streamCtx, resp)
+	var completionText strings.Builder
+	var usage *Usage
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-streamCtx.Done():
+			// Client disconnected; don't synthesize a [DONE] frame nobody
+			// will read. The deferred closeIO(resp.Body) unblocks the
+			// producer.
+			return false
+		case chunk, ok := <-stream:
+			if !ok {
+				endStr := "stop"
+				endResponse := ChatCompletionsStreamResponse{
+					Id:      id,
+					Object:  "chat.completion.chunk",
+					Created: GetTimestamp(),
+					Model:   rm.MappedModel,
+					Choices: []ChatCompletionsStreamResponseChoice{{FinishReason: &endStr}},
+				}
+				jsonStr, _ := json.Marshal(endResponse)
+				c.Render(-1, CustomEvent{Data: "data: " + string(jsonStr)})
+				c.Render(-1, CustomEvent{Data: "data: [DONE]"})
+				if nil != usage {
+					rm.PromptTokens = usage.PromptTokens
+					rm.CompletionTokens = usage.CompletionTokens
+				} else {
+					rm.CompletionTokens = estimateTokenCount(s.cfg, completionText.String())
+				}
+				return false
+			}
+			rm.MarkFirstByte(c.FullPath())
+			chunk.Id = id
+			chunk.Created = GetTimestamp()
+			if nil != chunk.Usage {
+				usage = chunk.Usage
+			}
+			if len(chunk.Choices) > 0 {
+				if content, ok := chunk.Choices[0].Delta.Content.(string); ok {
+					completionText.WriteString(content)
+				}
+			}
+			jsonStr, err := json.Marshal(chunk)
+			if nil != err {
+				log.Println("error marshalling stream response: ", err.Error())
+				return true
+			}
+			c.Render(-1, CustomEvent{Data: "data: " + string(jsonStr)})
+			return true
+		}
+	})
+}
+
+// replayCachedFrames serves a cached codex completion to the client
+// without contacting upstream at all.
+func replayCachedFrames(c *gin.Context, entry *CacheEntry) {
+	SetEventStreamHeaders(c)
+	c.Status(http.StatusOK)
+	i := 0
+	c.Stream(func(w io.Writer) bool {
+		if i >= len(entry.Frames) {
+			return false
+		}
+		c.Render(-1, CustomEvent{Data: entry.Frames[i]})
+		i++
+		return true
+	})
+}
+
+// storeCodexCache is a nil-safe helper so callers don't need to guard
+// every call site on whether caching is enabled or the request was
+// actually cacheable (cacheKey is empty when it wasn't).
+func (s *ProxyService) storeCodexCache(cacheKey string, frames []string) {
+	if nil == s.codexCache || "" == cacheKey {
+		return
+	}
+	s.codexCache.Store(cacheKey, frames)
+}
+
+// refreshCodexCache repopulates a stale cache entry in the background so
+// a stale-while-revalidate hit doesn't block the client that triggered it.
+func (s *ProxyService) refreshCodexCache(cacheKey string, body []byte) {
+	resp, provider, err := s.requestUpstream(context.Background(), s.codexKeyPool, s.cfg.CodexApiProvider, "completions", s.cfg.CodexApiBase, body)
+	if nil != err {
+		log.Println("cache refresh failed:", err.Error())
+		return
+	}
+	defer closeIO(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Println("cache refresh failed: upstream returned", resp.StatusCode)
+		return
+	}
+
+	id := "chatcmpl-cache-refresh"
+	fimTmpl, hasFimStop := lookupFimTemplate(s.cfg, s.cfg.CodeInstructModel)
+	hasFimStop = hasFimStop && len(fimTmpl.Stop) > 0
+	var frames []string
+	for chunk := range provider.TranslateStream(context.Background(), resp) {
+		chunk.Id = id
+		chunk.Model = s.cfg.CodeInstructModel
+		if hasFimStop {
+			for i := range chunk.Choices {
+				content, ok := chunk.Choices[i].Delta.Content.(string)
+				if !ok {
+					continue
+				}
+				chunk.Choices[i].Delta.Content = stripStopTokens(content, fimTmpl)
+			}
+		}
+		jsonStr, err := json.Marshal(chunk)
+		if nil != err {
+			continue
+		}
+		frames = append(frames, "data: "+string(jsonStr))
+	}
+	frames = append(frames, "data: [DONE]")
+	s.storeCodexCache(cacheKey, frames)
 }
 
 func (s *ProxyService) codeCompletions(c *gin.Context) {
@@ -379,37 +651,45 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 		return
 	}
 
-	body = ConstructRequestBody(body, s.cfg)
-
-	proxyUrl := s.cfg.CodexApiBase + "/completions"
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxyUrl, io.NopCloser(bytes.NewBuffer(body)))
-	if nil != err {
-		//
-		abortCodex(c, http.StatusInternalServerError)
-		return
+	rm := requestMetrics(c)
+	rm.Model = s.cfg.CodeInstructModel
+	rm.MappedModel = s.cfg.CodeInstructModel
+	rm.Upstream = s.cfg.CodexApiProvider
+	rm.PromptTokens = estimateTokenCount(s.cfg, gjson.GetBytes(body, "prompt").String()+gjson.GetBytes(body, "suffix").String())
+
+	var cacheKey string
+	if nil != s.codexCache {
+		cacheKey = cacheKeyForBody(body)
+		if entry, stale := s.codexCache.Lookup(cacheKey); nil != entry {
+			replayCachedFrames(c, entry)
+			if stale {
+				refreshBody := ConstructRequestBody(append([]byte(nil), body...), s.cfg)
+				go s.refreshCodexCache(cacheKey, refreshBody)
+			}
+			return
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+s.cfg.CodexApiKey)
-	if "" != s.cfg.CodexApiOrganization {
-		req.Header.Set("OpenAI-Organization", s.cfg.CodexApiOrganization)
-	}
-	if "" != s.cfg.CodexApiProject {
-		req.Header.Set("OpenAI-Project", s.cfg.CodexApiProject)
-	}
+	body = ConstructRequestBody(body, s.cfg)
 
-	resp, err := s.client.Do(req)
+	resp, provider, err := s.requestUpstream(ctx, s.codexKeyPool, s.cfg.CodexApiProvider, "completions", s.cfg.CodexApiBase, body)
 	if nil != err {
 		if errors.Is(err, context.Canceled) {
 			abortCodex(c, http.StatusRequestTimeout)
 			return
 		}
+		if errors.Is(err, ErrNoHealthyKeys) {
+			log.Println("request completions failed: no healthy codex api keys")
+			abortCodex(c, http.StatusBadGateway)
+			return
+		}
 
 		log.Println("request completions failed:", err.Error())
 		abortCodex(c, http.StatusInternalServerError)
 		return
 	}
 	defer closeIO(resp.Body)
+	rm.UpstreamStatus = resp.StatusCode
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
@@ -426,6 +706,87 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 		c.Header("Content-Type", contentType)
 	}
 
+	if !isOpenAICompatible(provider) {
+		SetEventStreamHeaders(c)
+		id := GetResponseID(c)
+		fimTmpl, hasFimStop := lookupFimTemplate(s.cfg, s.cfg.CodeInstructModel)
+		hasFimStop = hasFimStop && len(fimTmpl.Stop) > 0
+		// streamCtx is canceled when the client disconnects mid-stream, so
+		// TranslateStream's producer goroutine can stop trying to send
+		// instead of blocking forever on a channel nobody's reading from
+		// anymore.
+		streamCtx, cancelStream := context.WithCancel(c.Request.Context())
+		defer cancelStream()
+		stream := provider.TranslateStream(streamCtx, resp)
+		var cachedFrames []string
+		var completionText strings.Builder
+		var usage *Usage
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-streamCtx.Done():
+				// Client disconnected; don't synthesize a [DONE] frame
+				// nobody will read. resp.Body.Close() below unblocks the
+				// producer.
+				return false
+			case chunk, ok := <-stream:
+				if !ok {
+					endStr := `stop`
+					endResponse := ChatCompletionsStreamResponse{
+						Id:      id,
+						Object:  "chat.completion.chunk",
+						Created: GetTimestamp(),
+						Model:   s.cfg.CodeInstructModel,
+						Choices: []ChatCompletionsStreamResponseChoice{{FinishReason: &endStr}},
+					}
+					jsonStr, _ := json.Marshal(endResponse)
+					frame := "data: " + string(jsonStr)
+					c.Render(-1, CustomEvent{Data: frame})
+					c.Render(-1, CustomEvent{Data: "data: [DONE]"})
+					if nil != usage {
+						rm.PromptTokens = usage.PromptTokens
+						rm.CompletionTokens = usage.CompletionTokens
+					} else {
+						rm.CompletionTokens = estimateTokenCount(s.cfg, completionText.String())
+					}
+					s.storeCodexCache(cacheKey, append(cachedFrames, frame, "data: [DONE]"))
+					return false
+				}
+				rm.MarkFirstByte(c.FullPath())
+				chunk.Id = id
+				chunk.Created = GetTimestamp()
+				chunk.Model = s.cfg.CodeInstructModel
+				if nil != chunk.Usage {
+					usage = chunk.Usage
+				}
+				if hasFimStop {
+					for i := range chunk.Choices {
+						content, ok := chunk.Choices[i].Delta.Content.(string)
+						if !ok {
+							continue
+						}
+						chunk.Choices[i].Delta.Content = stripStopTokens(content, fimTmpl)
+					}
+				}
+				if len(chunk.Choices) > 0 {
+					if content, ok := chunk.Choices[0].Delta.Content.(string); ok {
+						completionText.WriteString(content)
+					}
+				}
+				jsonStr, err := json.Marshal(chunk)
+				if nil != err {
+					log.Println("error marshalling stream response: ", err.Error())
+					return true
+				}
+				frame := "data: " + string(jsonStr)
+				c.Render(-1, CustomEvent{Data: frame})
+				cachedFrames = append(cachedFrames, frame)
+				return true
+			}
+		})
+		_ = resp.Body.Close()
+		return
+	}
+
 	//_, _ = io.Copy(c.Writer, resp.Body)
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -440,6 +801,12 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 		}
 		return 0, nil, nil
 	})
+	// streamCtx is canceled when the client disconnects mid-stream, so the
+	// producer below can stop trying to send instead of blocking forever
+	// on a dataChan nobody's reading from anymore.
+	streamCtx, cancelStream := context.WithCancel(c.Request.Context())
+	defer cancelStream()
+
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 	go func() {
@@ -449,16 +816,33 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 				continue
 			}
 			data = strings.TrimPrefix(data, "data: ")
-			dataChan <- data
+			select {
+			case dataChan <- data:
+			case <-streamCtx.Done():
+				return
+			}
+		}
+		select {
+		case stopChan <- true:
+		case <-streamCtx.Done():
 		}
-		stopChan <- true
 	}()
 	SetEventStreamHeaders(c)
 	id := GetResponseID(c)
+	fimTmpl, hasFimStop := lookupFimTemplate(s.cfg, s.cfg.CodeInstructModel)
+	hasFimStop = hasFimStop && len(fimTmpl.Stop) > 0
+	var cachedFrames []string
+	var completionText strings.Builder
+	var usage *Usage
 	//responseModel := c.GetString("original_model")
 	c.Stream(func(w io.Writer) bool {
 		select {
+		case <-streamCtx.Done():
+			// Client disconnected; don't synthesize a [DONE] frame nobody
+			// will read. resp.Body.Close() below unblocks the scanner.
+			return false
 		case data := <-dataChan:
+			rm.MarkFirstByte(c.FullPath())
 			// some implementations may add \r at the end of data
 			data = strings.TrimSuffix(data, "\r")
 			var codeResponse ChatCompletionsStreamResponse
@@ -470,22 +854,34 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 				log.Println("error unmarshalling stream response: ", err.Error())
 				return true
 			}
-			if strings.HasPrefix(s.cfg.CodeInstructModel, "@") {
-				//for _, choiceData := range codeResponse.Choices {
-				//	choiceData.Index = 1
-				//}
-				if codeResponse.Choices[0].Delta.Content == "<｜end▁of▁sentence｜>" {
-					codeResponse.Choices[0].Delta.Content = ""
+			if nil != codeResponse.Usage {
+				usage = codeResponse.Usage
+			}
+			var frame string
+			if hasFimStop {
+				for i := range codeResponse.Choices {
+					content, ok := codeResponse.Choices[i].Delta.Content.(string)
+					if !ok {
+						continue
+					}
+					codeResponse.Choices[i].Delta.Content = stripStopTokens(content, fimTmpl)
 				}
 				jsonStr, err := json.Marshal(codeResponse)
 				if err != nil {
 					log.Println("error marshalling stream response: ", err.Error())
 					return true
 				}
-				c.Render(-1, CustomEvent{Data: "data: " + string(jsonStr)})
+				frame = "data: " + string(jsonStr)
 			} else {
-				c.Render(-1, CustomEvent{Data: "data:" + string(data)})
+				frame = "data:" + string(data)
+			}
+			for i := range codeResponse.Choices {
+				if content, ok := codeResponse.Choices[i].Delta.Content.(string); ok {
+					completionText.WriteString(content)
+				}
 			}
+			c.Render(-1, CustomEvent{Data: frame})
+			cachedFrames = append(cachedFrames, frame)
 			return true
 		case <-stopChan:
 			endStr := `stop`
@@ -505,8 +901,16 @@ func (s *ProxyService) codeCompletions(c *gin.Context) {
 				log.Println("error marshalling stream response: ", err.Error())
 				return true
 			}
-			c.Render(-1, CustomEvent{Data: "data: " + string(jsonStr)})
+			frame := "data: " + string(jsonStr)
+			c.Render(-1, CustomEvent{Data: frame})
 			c.Render(-1, CustomEvent{Data: "data: [DONE]"})
+			if nil != usage {
+				rm.PromptTokens = usage.PromptTokens
+				rm.CompletionTokens = usage.CompletionTokens
+			} else {
+				rm.CompletionTokens = estimateTokenCount(s.cfg, completionText.String())
+			}
+			s.storeCodexCache(cacheKey, append(cachedFrames, frame, "data: [DONE]"))
 			return false
 		}
 	})
@@ -517,10 +921,11 @@ func ConstructRequestBody(body []byte, cfg *config) []byte {
 	body, _ = sjson.DeleteBytes(body, "extra")
 	body, _ = sjson.DeleteBytes(body, "nwo")
 	body, _ = sjson.SetBytes(body, "model", cfg.CodeInstructModel)
-	if strings.Contains(cfg.CodeInstructModel, StableCodeModelPrefix) {
-		return constructWithStableCodeModel(body)
-	} else if strings.HasPrefix(cfg.CodeInstructModel, "@") {
-		return constructWithCfCodeModel(body)
+
+	body = TrimPrompt(body, cfg)
+
+	if tmpl, ok := lookupFimTemplate(cfg, cfg.CodeInstructModel); ok {
+		return constructWithFimTemplate(body, tmpl)
 	}
 	if strings.HasSuffix(cfg.ChatApiBase, "chat") {
 		// @Todo  constructWithChatModel
@@ -529,36 +934,6 @@ func ConstructRequestBody(body []byte, cfg *config) []byte {
 	return body
 }
 
-func constructWithCfCodeModel(body []byte) []byte {
-	suffix := gjson.GetBytes(body, "suffix")
-	prompt := gjson.GetBytes(body, "prompt")
-	content := fmt.Sprintf("<｜fim▁begin｜>%s<｜fim▁hole｜>%s<｜fim▁end｜>", prompt, suffix)
-
-	// 创建新的 JSON 对象并添加到 body 中
-	messages := []map[string]string{
-		{
-			"role":    "user",
-			"content": content,
-		},
-	}
-	return constructWithChatModel(body, messages)
-}
-
-func constructWithStableCodeModel(body []byte) []byte {
-	suffix := gjson.GetBytes(body, "suffix")
-	prompt := gjson.GetBytes(body, "prompt")
-	content := fmt.Sprintf("<fim_prefix>%s<fim_suffix>%s<fim_middle>", prompt, suffix)
-
-	// 创建新的 JSON 对象并添加到 body 中
-	messages := []map[string]string{
-		{
-			"role":    "user",
-			"content": content,
-		},
-	}
-	return constructWithChatModel(body, messages)
-}
-
 func constructWithChatModel(body []byte, messages interface{}) []byte {
 
 	body, _ = sjson.SetBytes(body, "messages", messages)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "override_request_duration_seconds",
+			Help:    "Latency of proxied requests, by route and final status.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "status"},
+	)
+	upstreamStatusTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "override_upstream_status_total",
+			Help: "Count of upstream responses, by route and status code.",
+		},
+		[]string{"route", "status"},
+	)
+	promptTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "override_prompt_tokens",
+			Help: "Prompt tokens on the most recent request, by route.",
+		},
+		[]string{"route"},
+	)
+	completionTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "override_completion_tokens",
+			Help: "Completion tokens on the most recent response, by route.",
+		},
+		[]string{"route"},
+	)
+	streamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "override_stream_duration_seconds",
+			Help:    "Total duration of a streamed completion, by route.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+	timeToFirstByte = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "override_ttfb_seconds",
+			Help:    "Time to the first streamed byte, by route.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, upstreamStatusTotal, promptTokens, completionTokens, streamDuration, timeToFirstByte)
+}
+
+const requestMetricsKey = "override_request_metrics"
+
+// RequestMetrics accumulates the bits of a request the generic
+// MetricsMiddleware can't see on its own - upstream identity, token
+// counts, TTFB - so the handler can fill them in as it goes and the
+// middleware can report and log them once the request finishes.
+type RequestMetrics struct {
+	Model            string
+	MappedModel      string
+	Upstream         string
+	UpstreamStatus   int
+	PromptTokens     int
+	CompletionTokens int
+
+	start     time.Time
+	firstByte time.Time
+}
+
+// requestMetrics fetches (or lazily creates) the RequestMetrics for c.
+func requestMetrics(c *gin.Context) *RequestMetrics {
+	if v, ok := c.Get(requestMetricsKey); ok {
+		return v.(*RequestMetrics)
+	}
+	rm := &RequestMetrics{start: time.Now()}
+	c.Set(requestMetricsKey, rm)
+	return rm
+}
+
+// MarkFirstByte records TTFB the first time it's called for a request;
+// later calls are no-ops.
+func (rm *RequestMetrics) MarkFirstByte(route string) {
+	if !rm.firstByte.IsZero() {
+		return
+	}
+	rm.firstByte = time.Now()
+	timeToFirstByte.WithLabelValues(route).Observe(rm.firstByte.Sub(rm.start).Seconds())
+}
+
+// estimateTokenCount counts text's tokens with cfg's configured BPE
+// encoding, falling back to a ~4-chars-per-token estimate when no
+// tokenizer is available.
+func estimateTokenCount(cfg *config, text string) int {
+	if "" == text {
+		return 0
+	}
+	if tokenizer, err := newTokenizer(cfg.Encoding); nil == err {
+		return len(tokenizer.Encode(text))
+	}
+	return len(text) / 4
+}
+
+// MetricsMiddleware records per-route latency/status in Prometheus and
+// emits one structured JSON access log line per request.
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rm := requestMetrics(c)
+		c.Next()
+
+		route := c.FullPath()
+		status := c.Writer.Status()
+		elapsed := time.Since(rm.start)
+
+		requestDuration.WithLabelValues(route, strconv.Itoa(status)).Observe(elapsed.Seconds())
+		if rm.UpstreamStatus != 0 {
+			upstreamStatusTotal.WithLabelValues(route, strconv.Itoa(rm.UpstreamStatus)).Inc()
+		}
+		if rm.PromptTokens > 0 {
+			promptTokens.WithLabelValues(route).Set(float64(rm.PromptTokens))
+		}
+		if rm.CompletionTokens > 0 {
+			completionTokens.WithLabelValues(route).Set(float64(rm.CompletionTokens))
+		}
+		if !rm.firstByte.IsZero() {
+			streamDuration.WithLabelValues(route).Observe(elapsed.Seconds())
+		}
+
+		entry, err := json.Marshal(map[string]interface{}{
+			"request_id":        GetResponseID(c),
+			"route":             route,
+			"status":            status,
+			"model":             rm.Model,
+			"mapped_model":      rm.MappedModel,
+			"upstream":          rm.Upstream,
+			"upstream_status":   rm.UpstreamStatus,
+			"prompt_tokens":     rm.PromptTokens,
+			"completion_tokens": rm.CompletionTokens,
+			"elapsed_ms":        elapsed.Milliseconds(),
+		})
+		if nil != err {
+			log.Println("error marshalling access log:", err.Error())
+			return
+		}
+		log.Println(string(entry))
+	}
+}
+
+// metricsHandler exposes Prometheus metrics. When AuthToken is
+// configured, InitRoutes serves it at /:token/metrics behind the same
+// AuthMiddleware as the v1 routes.
+func metricsHandler() gin.HandlerFunc {
+	h := promhttp.Handler()
+	return func(c *gin.Context) {
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
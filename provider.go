@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Provider adapts the OpenAI chat/completions wire format that Copilot
+// speaks to whatever an upstream model host actually expects, so the rest
+// of the proxy only ever has to deal in OpenAI-shaped requests/responses.
+type Provider interface {
+	// BuildRequest turns an OpenAI-format request body into the URL,
+	// headers and payload to send upstream.
+	BuildRequest(body []byte) (reqURL string, headers map[string]string, payload []byte, err error)
+	// TranslateStream normalizes the upstream response body into a
+	// channel of OpenAI-format stream chunks. The channel is closed once
+	// the upstream response has been fully drained or ctx is canceled,
+	// whichever happens first; the producer never blocks forever on a
+	// reader nobody's servicing anymore.
+	TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse
+}
+
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderGemini    = "gemini"
+	ProviderOllama    = "ollama"
+	ProviderAzure     = "azure"
+)
+
+// providerConfig carries the bits of config a Provider needs to reach its
+// upstream. kind distinguishes the chat/completions callers (Copilot
+// Chat) from the legacy completions caller (Copilot's codex completions).
+type providerConfig struct {
+	kind         string // "chat" or "completions"
+	apiBase      string
+	apiKey       string
+	organization string
+	project      string
+	apiVersion   string
+}
+
+// NewProvider selects the Provider implementation for name, defaulting to
+// the OpenAI-compatible passthrough when name is empty or unrecognised.
+func NewProvider(name string, pc providerConfig) Provider {
+	switch name {
+	case ProviderAnthropic:
+		return &anthropicProvider{pc}
+	case ProviderGemini:
+		return &geminiProvider{pc}
+	case ProviderOllama:
+		return &ollamaProvider{pc}
+	case ProviderAzure:
+		return &azureProvider{pc}
+	default:
+		return &openAIProvider{pc}
+	}
+}
+
+func (pc providerConfig) path() string {
+	if pc.kind == "completions" {
+		return "/completions"
+	}
+	return "/chat/completions"
+}
+
+// isOpenAICompatible reports whether provider speaks the OpenAI wire
+// format byte-for-byte, so callers can stream its response straight
+// through instead of round-tripping it through TranslateStream and
+// losing any fields ChatCompletionsStreamResponse doesn't model (e.g.
+// tool_calls, logprobs).
+func isOpenAICompatible(provider Provider) bool {
+	switch provider.(type) {
+	case *openAIProvider, *azureProvider:
+		return true
+	default:
+		return false
+	}
+}
+
+// openAIProvider talks to any OpenAI-compatible upstream (the default
+// today, and what Azure/most local inference servers also imitate).
+type openAIProvider struct {
+	providerConfig
+}
+
+func (p *openAIProvider) BuildRequest(body []byte) (string, map[string]string, []byte, error) {
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + p.apiKey,
+	}
+	if "" != p.organization {
+		headers["OpenAI-Organization"] = p.organization
+	}
+	if "" != p.project {
+		headers["OpenAI-Project"] = p.project
+	}
+	return p.apiBase + p.path(), headers, body, nil
+}
+
+func (p *openAIProvider) TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse {
+	out := make(chan ChatCompletionsStreamResponse)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimPrefix(scanner.Text(), "data: ")
+			line = strings.TrimSuffix(line, "\r")
+			if line == "" || line == "[DONE]" {
+				continue
+			}
+			var chunk ChatCompletionsStreamResponse
+			if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+				continue
+			}
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// azureProvider talks to Azure OpenAI's deployment-based URL scheme:
+// the model name becomes the deployment segment of the path and auth is
+// an api-key header rather than a bearer token. The wire format on top
+// of that is otherwise identical to OpenAI's.
+type azureProvider struct {
+	providerConfig
+}
+
+func (p *azureProvider) BuildRequest(body []byte) (string, map[string]string, []byte, error) {
+	model := gjson.GetBytes(body, "model").String()
+	apiVersion := p.apiVersion
+	if "" == apiVersion {
+		apiVersion = "2024-02-15-preview"
+	}
+	reqURL := p.apiBase + "/openai/deployments/" + model + p.path() + "?api-version=" + apiVersion
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"api-key":      p.apiKey,
+	}
+	return reqURL, headers, body, nil
+}
+
+func (p *azureProvider) TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse {
+	return (&openAIProvider{p.providerConfig}).TranslateStream(ctx, resp)
+}
+
+// anthropicProvider talks to the Anthropic Messages API.
+type anthropicProvider struct {
+	providerConfig
+}
+
+func (p *anthropicProvider) BuildRequest(body []byte) (string, map[string]string, []byte, error) {
+	payload := []byte(`{}`)
+	payload, _ = sjson.SetBytes(payload, "model", gjson.GetBytes(body, "model").String())
+	payload, _ = sjson.SetBytes(payload, "stream", true)
+
+	maxTokens := gjson.GetBytes(body, "max_tokens").Int()
+	if maxTokens == 0 {
+		maxTokens = 4096
+	}
+	payload, _ = sjson.SetBytes(payload, "max_tokens", maxTokens)
+
+	var messages []map[string]string
+	for _, m := range gjson.GetBytes(body, "messages").Array() {
+		role := m.Get("role").String()
+		if role == "system" {
+			payload, _ = sjson.SetBytes(payload, "system", m.Get("content").String())
+			continue
+		}
+		if role == "assistant" {
+			role = "assistant"
+		} else {
+			role = "user"
+		}
+		messages = append(messages, map[string]string{
+			"role":    role,
+			"content": m.Get("content").String(),
+		})
+	}
+	payload, _ = sjson.SetBytes(payload, "messages", messages)
+
+	if stop := gjson.GetBytes(body, "stop").Array(); len(stop) > 0 {
+		stopSequences := make([]string, 0, len(stop))
+		for _, s := range stop {
+			stopSequences = append(stopSequences, s.String())
+		}
+		payload, _ = sjson.SetBytes(payload, "stop_sequences", stopSequences)
+	}
+
+	headers := map[string]string{
+		"Content-Type":      "application/json",
+		"x-api-key":         p.apiKey,
+		"anthropic-version": "2023-06-01",
+	}
+	return p.apiBase + "/v1/messages", headers, payload, nil
+}
+
+func (p *anthropicProvider) TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse {
+	out := make(chan ChatCompletionsStreamResponse)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimPrefix(scanner.Text(), "data: ")
+			if line == "" {
+				continue
+			}
+			event := gjson.Parse(line)
+			switch event.Get("type").String() {
+			case "content_block_delta":
+				text := event.Get("delta.text").String()
+				if text == "" {
+					continue
+				}
+				select {
+				case out <- ChatCompletionsStreamResponse{
+					Object: "chat.completion.chunk",
+					Choices: []ChatCompletionsStreamResponseChoice{
+						{Delta: Message{Role: "assistant", Content: text}},
+					},
+				}:
+				case <-ctx.Done():
+					return
+				}
+			case "message_stop":
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// geminiProvider talks to Google's Gemini generateContent API.
+type geminiProvider struct {
+	providerConfig
+}
+
+func (p *geminiProvider) BuildRequest(body []byte) (string, map[string]string, []byte, error) {
+	model := gjson.GetBytes(body, "model").String()
+	reqURL := p.apiBase + "/v1beta/models/" + model + ":streamGenerateContent?alt=sse"
+
+	payload := []byte(`{}`)
+	var contents []map[string]any
+	for _, m := range gjson.GetBytes(body, "messages").Array() {
+		role := m.Get("role").String()
+		if role == "system" {
+			payload, _ = sjson.SetBytes(payload, "systemInstruction.parts.0.text", m.Get("content").String())
+			continue
+		}
+		if role == "assistant" {
+			role = "model"
+		} else {
+			role = "user"
+		}
+		contents = append(contents, map[string]any{
+			"role":  role,
+			"parts": []map[string]string{{"text": m.Get("content").String()}},
+		})
+	}
+	payload, _ = sjson.SetBytes(payload, "contents", contents)
+
+	if stop := gjson.GetBytes(body, "stop").Array(); len(stop) > 0 {
+		stopSequences := make([]string, 0, len(stop))
+		for _, s := range stop {
+			stopSequences = append(stopSequences, s.String())
+		}
+		payload, _ = sjson.SetBytes(payload, "generationConfig.stopSequences", stopSequences)
+	}
+
+	headers := map[string]string{
+		"Content-Type":   "application/json",
+		"x-goog-api-key": p.apiKey,
+	}
+	return reqURL, headers, payload, nil
+}
+
+func (p *geminiProvider) TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse {
+	out := make(chan ChatCompletionsStreamResponse)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimPrefix(scanner.Text(), "data: ")
+			if line == "" {
+				continue
+			}
+			text := gjson.Parse(line).Get("candidates.0.content.parts.0.text").String()
+			if text == "" {
+				continue
+			}
+			select {
+			case out <- ChatCompletionsStreamResponse{
+				Object: "chat.completion.chunk",
+				Choices: []ChatCompletionsStreamResponseChoice{
+					{Delta: Message{Role: "assistant", Content: text}},
+				},
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// ollamaProvider talks to a local Ollama server's /api/chat endpoint,
+// which streams newline-delimited JSON objects rather than SSE.
+type ollamaProvider struct {
+	providerConfig
+}
+
+func (p *ollamaProvider) BuildRequest(body []byte) (string, map[string]string, []byte, error) {
+	payload, _ := sjson.SetBytes(body, "stream", true)
+	payload, _ = sjson.DeleteBytes(payload, "max_tokens")
+	headers := map[string]string{"Content-Type": "application/json"}
+	return p.apiBase + "/api/chat", headers, payload, nil
+}
+
+func (p *ollamaProvider) TranslateStream(ctx context.Context, resp *http.Response) <-chan ChatCompletionsStreamResponse {
+	out := make(chan ChatCompletionsStreamResponse)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			obj := gjson.Parse(line)
+			if obj.Get("done").Bool() {
+				return
+			}
+			content := obj.Get("message.content").String()
+			if content == "" {
+				continue
+			}
+			select {
+			case out <- ChatCompletionsStreamResponse{
+				Object: "chat.completion.chunk",
+				Choices: []ChatCompletionsStreamResponseChoice{
+					{Delta: Message{Role: "assistant", Content: content}},
+				},
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Tokenizer counts and slices text the same way the upstream model would,
+// so trimming decisions are made in tokens rather than bytes/runes.
+type Tokenizer interface {
+	Encode(text string) []int
+	Decode(tokens []int) string
+}
+
+type bpeTokenizer struct {
+	enc *tiktoken.Tiktoken
+}
+
+func newTokenizer(encoding string) (Tokenizer, error) {
+	if "" == encoding {
+		encoding = "cl100k_base"
+	}
+	enc, err := tiktoken.GetEncoding(encoding)
+	if nil != err {
+		return nil, err
+	}
+	return &bpeTokenizer{enc: enc}, nil
+}
+
+func (t *bpeTokenizer) Encode(text string) []int {
+	return t.enc.Encode(text, nil, nil)
+}
+
+func (t *bpeTokenizer) Decode(tokens []int) string {
+	return t.enc.Decode(tokens)
+}
+
+// pathBlockRe marks the neighboring-file headers Copilot stitches into a
+// codex prompt, e.g. "# Path: foo/bar.py" or "// Path: foo/bar.go".
+var pathBlockRe = regexp.MustCompile(`(?m)^(?:#|//) Path:.*$`)
+
+// splitPathBlocks splits prompt into the chunks introduced by those
+// headers, in the order they appear. The last block is always the
+// current file (the one the cursor is in), since Copilot assembles
+// neighboring-tab context before it.
+func splitPathBlocks(prompt string) []string {
+	locs := pathBlockRe.FindAllStringIndex(prompt, -1)
+	if len(locs) == 0 {
+		return []string{prompt}
+	}
+
+	var blocks []string
+	if locs[0][0] > 0 {
+		blocks = append(blocks, prompt[:locs[0][0]])
+	}
+	for i, loc := range locs {
+		end := len(prompt)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		blocks = append(blocks, prompt[loc[0]:end])
+	}
+	return blocks
+}
+
+// TrimPrompt fits prompt+suffix into cfg.ContextWindow tokens when the
+// upstream model's window is smaller than the one Copilot assumed. It
+// preserves the text closest to the cursor: the tail of prompt and the
+// head of suffix, dropping whole neighboring-file blocks furthest from
+// the cursor before falling back to a hard token-count truncation.
+func TrimPrompt(body []byte, cfg *config) []byte {
+	if cfg.ContextWindow <= 0 {
+		return body
+	}
+
+	tokenizer, err := newTokenizer(cfg.Encoding)
+	if nil != err {
+		log.Println("trim prompt: unable to load tokenizer:", err.Error())
+		return body
+	}
+
+	reserved := int(gjson.GetBytes(body, "max_tokens").Int())
+	if reserved <= 0 {
+		reserved = 256
+	}
+	budget := cfg.ContextWindow - reserved
+	if budget <= 0 {
+		return body
+	}
+
+	// Give the head of the suffix a third of the remaining budget and
+	// the tail of the prompt the rest; the prompt is usually the more
+	// important half since it includes everything up to the cursor.
+	suffixBudget := budget / 3
+	promptBudget := budget - suffixBudget
+
+	prompt := gjson.GetBytes(body, "prompt").String()
+	suffix := gjson.GetBytes(body, "suffix").String()
+
+	trimmedPrompt, promptRemoved := trimPromptToBudget(tokenizer, prompt, promptBudget)
+	trimmedSuffix, suffixRemoved := trimSuffixToBudget(tokenizer, suffix, suffixBudget)
+
+	if promptRemoved > 0 || suffixRemoved > 0 {
+		log.Printf("trim prompt: dropped %d prompt token(s) and %d suffix token(s) to fit a %d-token context window\n",
+			promptRemoved, suffixRemoved, cfg.ContextWindow)
+	}
+
+	body, _ = sjson.SetBytes(body, "prompt", trimmedPrompt)
+	body, _ = sjson.SetBytes(body, "suffix", trimmedSuffix)
+	return body
+}
+
+func trimPromptToBudget(tokenizer Tokenizer, prompt string, budget int) (string, int) {
+	if len(tokenizer.Encode(prompt)) <= budget {
+		return prompt, 0
+	}
+
+	removed := 0
+	blocks := splitPathBlocks(prompt)
+	for len(blocks) > 1 && len(tokenizer.Encode(strings.Join(blocks, ""))) > budget {
+		removed += len(tokenizer.Encode(blocks[0]))
+		blocks = blocks[1:]
+	}
+
+	remaining := strings.Join(blocks, "")
+	tokens := tokenizer.Encode(remaining)
+	if len(tokens) > budget {
+		removed += len(tokens) - budget
+		remaining = tokenizer.Decode(tokens[len(tokens)-budget:])
+	}
+	return remaining, removed
+}
+
+func trimSuffixToBudget(tokenizer Tokenizer, suffix string, budget int) (string, int) {
+	tokens := tokenizer.Encode(suffix)
+	if len(tokens) <= budget {
+		return suffix, 0
+	}
+	removed := len(tokens) - budget
+	return tokenizer.Decode(tokens[:budget]), removed
+}
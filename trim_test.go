@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// wordTokenizer is a deterministic stand-in for the real BPE tokenizer so
+// trim budget tests don't depend on tiktoken's remote rank files: one
+// token per whitespace-separated word.
+type wordTokenizer struct{}
+
+func (wordTokenizer) Encode(text string) []int {
+	if text == "" {
+		return nil
+	}
+	return make([]int, len(strings.Fields(text)))
+}
+
+func (wordTokenizer) Decode(tokens []int) string {
+	words := make([]string, len(tokens))
+	for i := range words {
+		words[i] = "w"
+	}
+	return strings.Join(words, " ")
+}
+
+func TestTrimPromptToBudgetUnderBudgetUnchanged(t *testing.T) {
+	prompt := "one two three"
+	got, removed := trimPromptToBudget(wordTokenizer{}, prompt, 5)
+	if got != prompt || removed != 0 {
+		t.Fatalf("got (%q, %d), want (%q, 0)", got, removed, prompt)
+	}
+}
+
+func TestTrimPromptToBudgetDropsWholeBlocksFirst(t *testing.T) {
+	prompt := "// Path: a.go\none two three\n// Path: b.go\nfour five"
+	got, removed := trimPromptToBudget(wordTokenizer{}, prompt, 4)
+	if strings.Contains(got, "a.go") {
+		t.Fatalf("expected the oldest path block to be dropped before falling back to a hard cut, got %q", got)
+	}
+	if removed <= 0 {
+		t.Fatal("expected some tokens to be reported as removed")
+	}
+}
+
+func TestTrimPromptToBudgetHardTruncatesWhenNoBlocks(t *testing.T) {
+	prompt := "one two three four five"
+	got, removed := trimPromptToBudget(wordTokenizer{}, prompt, 2)
+	if len(wordTokenizer{}.Encode(got)) > 2 {
+		t.Fatalf("result %q exceeds the 2-token budget", got)
+	}
+	if removed != 3 {
+		t.Fatalf("removed = %d, want 3", removed)
+	}
+}
+
+func TestTrimSuffixToBudgetUnderBudgetUnchanged(t *testing.T) {
+	suffix := "one two"
+	got, removed := trimSuffixToBudget(wordTokenizer{}, suffix, 5)
+	if got != suffix || removed != 0 {
+		t.Fatalf("got (%q, %d), want (%q, 0)", got, removed, suffix)
+	}
+}
+
+func TestTrimSuffixToBudgetTruncatesFromTheTail(t *testing.T) {
+	suffix := "one two three four"
+	_, removed := trimSuffixToBudget(wordTokenizer{}, suffix, 2)
+	if removed != 2 {
+		t.Fatalf("removed = %d, want 2", removed)
+	}
+}
+
+func TestSplitPathBlocksPreservesOrderAndLastBlockIsCurrentFile(t *testing.T) {
+	prompt := "// Path: a.go\nfoo\n// Path: b.go\nbar"
+	blocks := splitPathBlocks(prompt)
+	if len(blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(blocks))
+	}
+	if !strings.HasPrefix(blocks[len(blocks)-1], "// Path: b.go") {
+		t.Fatalf("last block should be the current file's, got %q", blocks[len(blocks)-1])
+	}
+}